@@ -3,18 +3,68 @@ package sphinx
 import (
 	"crypto/sha256"
 	"errors"
+	"sync"
 )
 
 const (
-	// HashPrefixSize is the size in bytes of the keys we will be storing
-	// in the ReplayLog. It represents the first 20 bytes of a truncated
-	// sha-256 hash of a secret generated by ECDH.
-	HashPrefixSize = 20
+	// DefaultHashPrefixSize is the size in bytes of the prefixes
+	// produced by DefaultReplayHasher. It represents the first 20 bytes
+	// of a truncated sha-256 hash of a secret generated by ECDH.
+	DefaultHashPrefixSize = 20
 )
 
-// HashPrefix is a statically size, 20-byte array containing the prefix
-// of a Hash256, and is used to detect duplicate sphinx packets.
-type HashPrefix [HashPrefixSize]byte
+// HashPrefix is the prefix of a hashed shared secret, used to detect
+// duplicate sphinx packets. Unlike earlier versions of this package, its
+// length is not fixed: it is determined by whichever ReplayHasher produced
+// it, allowing operators to trade a larger prefix for a lower collision
+// probability as the network grows, or to substitute a non-BOLT-standard
+// hash entirely. A ReplayLog storing prefixes produced by
+// DefaultReplayHasher is byte-for-byte compatible with logs written before
+// ReplayHasher was introduced, since DefaultReplayHasher reproduces the
+// original 20-byte SHA-256 scheme exactly.
+type HashPrefix []byte
+
+// ReplayHasher computes the ReplayLog prefix derived from a sphinx
+// packet's shared secret. Implementations are free to choose any hash
+// function and any prefix length.
+type ReplayHasher interface {
+	// Hash derives the replay-log prefix for the given shared secret.
+	Hash(shared *Hash256) HashPrefix
+
+	// PrefixLen returns the length, in bytes, of the prefixes produced
+	// by Hash.
+	PrefixLen() int
+}
+
+// sha256ReplayHasher is the ReplayHasher backing DefaultReplayHasher. It
+// truncates a SHA-256 digest of the shared secret to DefaultHashPrefixSize
+// bytes, matching the hashing scheme used throughout this package prior to
+// the introduction of ReplayHasher.
+type sha256ReplayHasher struct{}
+
+// Hash computes the truncated SHA-256 digest of shared.
+func (sha256ReplayHasher) Hash(shared *Hash256) HashPrefix {
+	h := sha256.New()
+	h.Write(shared[:])
+
+	return HashPrefix(h.Sum(nil)[:DefaultHashPrefixSize])
+}
+
+// PrefixLen returns DefaultHashPrefixSize.
+func (sha256ReplayHasher) PrefixLen() int {
+	return DefaultHashPrefixSize
+}
+
+// DefaultReplayHasher is the ReplayHasher used throughout this package when
+// no other ReplayHasher is configured. It reproduces the fixed 20-byte
+// SHA-256 scheme this package has always used, so existing on-disk
+// ReplayLogs continue to work unmodified as long as DefaultReplayHasher
+// remains in use.
+var DefaultReplayHasher ReplayHasher = sha256ReplayHasher{}
+
+// A compile time assertion to ensure sha256ReplayHasher implements the
+// ReplayHasher interface.
+var _ ReplayHasher = sha256ReplayHasher{}
 
 var (
 	// errReplayLogNotStarted is an error returned when methods other than Start()
@@ -22,24 +72,24 @@ var (
 	errReplayLogNotStarted = errors.New("replay log has not been started")
 )
 
-// hashSharedSecret Sha-256 hashes the shared secret and returns the first
-// HashPrefixSize bytes of the hash.
-func hashSharedSecret(sharedSecret *Hash256) *HashPrefix {
-	// Sha256 hash of sharedSecret
-	h := sha256.New()
-	h.Write(sharedSecret[:])
-
-	var sharedHash HashPrefix
+// hashSharedSecret derives the replay-log prefix for sharedSecret using
+// hasher. If hasher is nil, DefaultReplayHasher is used, reproducing the
+// package's original SHA-256-based behavior.
+func hashSharedSecret(sharedSecret *Hash256, hasher ReplayHasher) HashPrefix {
+	if hasher == nil {
+		hasher = DefaultReplayHasher
+	}
 
-	// Copy bytes to sharedHash
-	copy(sharedHash[:], h.Sum(nil))
-	return &sharedHash
+	return hasher.Hash(sharedSecret)
 }
 
 // ReplayLog is an interface that defines a log of incoming sphinx packets,
 // enabling strong replay protection. The interface is general to allow
 // implementations near-complete autonomy. All methods must be safe for
-// concurrent access.
+// concurrent access. The HashPrefix values passed to its methods are
+// produced by a ReplayHasher; callers must use the same ReplayHasher for
+// the lifetime of a given log, since prefixes derived with different
+// hashers are not comparable.
 type ReplayLog interface {
 	// Start starts up the log. It returns an error if one occurs.
 	Start() error
@@ -67,12 +117,15 @@ type ReplayLog interface {
 }
 
 // MemoryReplayLog is a simple ReplayLog implementation that stores all added
-// sphinx packets and processed batches in memory with no persistence.
+// sphinx packets and processed batches in memory with no persistence. All
+// methods are safe for concurrent access, guarded by a single mutex.
 //
 // This is designed for use just in testing.
 type MemoryReplayLog struct {
+	mu sync.Mutex
+
 	batches map[string]*ReplaySet
-	entries map[HashPrefix]uint32
+	entries map[string]uint32
 }
 
 // NewMemoryReplayLog constructs a new MemoryReplayLog.
@@ -82,13 +135,19 @@ func NewMemoryReplayLog() *MemoryReplayLog {
 
 // Start initializes the log and must be called before any other methods.
 func (rl *MemoryReplayLog) Start() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	rl.batches = make(map[string]*ReplaySet)
-	rl.entries = make(map[HashPrefix]uint32)
+	rl.entries = make(map[string]uint32)
 	return nil
 }
 
 // Stop wipes the state of the log.
 func (rl *MemoryReplayLog) Stop() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
@@ -102,11 +161,14 @@ func (rl *MemoryReplayLog) Stop() error {
 // value stored and an error if one occurs. It returns ErrLogEntryNotFound
 // if the entry is not in the log.
 func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return 0, errReplayLogNotStarted
 	}
 
-	cltv, exists := rl.entries[*hash]
+	cltv, exists := rl.entries[string(*hash)]
 	if !exists {
 		return 0, ErrLogEntryNotFound
 	}
@@ -118,26 +180,38 @@ func (rl *MemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
 // purposefully general type. It returns ErrReplayedPacket if the provided hash
 // prefix already exists in the log.
 func (rl *MemoryReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.putLocked(hash, cltv)
+}
+
+// putLocked is the body of Put, factored out so that PutBatch can reuse it
+// while already holding rl.mu.
+func (rl *MemoryReplayLog) putLocked(hash *HashPrefix, cltv uint32) error {
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
 
-	_, exists := rl.entries[*hash]
+	_, exists := rl.entries[string(*hash)]
 	if exists {
 		return ErrReplayedPacket
 	}
 
-	rl.entries[*hash] = cltv
+	rl.entries[string(*hash)] = cltv
 	return nil
 }
 
 // Delete deletes an entry from the log given its hash prefix.
 func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return errReplayLogNotStarted
 	}
 
-	delete(rl.entries, *hash)
+	delete(rl.entries, string(*hash))
 	return nil
 }
 
@@ -145,6 +219,9 @@ func (rl *MemoryReplayLog) Delete(hash *HashPrefix) error {
 // prefixes and accompanying values. Returns the set of entries in the batch
 // that are replays and an error if one occurs.
 func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	if rl.entries == nil || rl.batches == nil {
 		return nil, errReplayLogNotStarted
 	}
@@ -156,7 +233,7 @@ func (rl *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
 	if !exists {
 		replays = NewReplaySet()
 		err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix, cltv uint32) error {
-			err := rl.Put(hashPrefix, cltv)
+			err := rl.putLocked(hashPrefix, cltv)
 			if errors.Is(err, ErrReplayedPacket) {
 				replays.Add(seqNum)
 				return nil
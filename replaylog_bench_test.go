@@ -0,0 +1,156 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// benchReplayLogImpls enumerates the ReplayLog implementations compared by
+// the benchmarks in this file, so that future implementations can be added
+// here and compared apples-to-apples against the existing ones.
+var benchReplayLogImpls = map[string]func(b *testing.B) ReplayLog{
+	"memory": func(b *testing.B) ReplayLog {
+		return NewMemoryReplayLog()
+	},
+	"sharded": func(b *testing.B) ReplayLog {
+		return NewShardedMemoryReplayLog()
+	},
+	"persistent": func(b *testing.B) ReplayLog {
+		dbPath := filepath.Join(b.TempDir(), "replay.db")
+		return NewPersistentReplayLog(dbPath, WithNoSync())
+	},
+}
+
+// concurrencyLevels are the parallelism multipliers (relative to
+// GOMAXPROCS) each benchmark is run at, via testing.B.SetParallelism.
+var concurrencyLevels = []int{1, 4, 16}
+
+// BenchmarkGet measures Get throughput against a single, already-present
+// entry, at varying levels of concurrency.
+func BenchmarkGet(b *testing.B) {
+	for name, newLog := range benchReplayLogImpls {
+		for _, level := range concurrencyLevels {
+			b.Run(fmt.Sprintf("%s/concurrency-%d", name, level), func(b *testing.B) {
+				rl := newLog(b)
+				requireNoErr(b, rl.Start())
+				b.Cleanup(func() { requireNoErr(b, rl.Stop()) })
+
+				hashPrefix := testHashPrefix(1)
+				requireNoErr(b, rl.Put(&hashPrefix, 1))
+
+				b.ReportAllocs()
+				b.SetParallelism(level)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := rl.Get(&hashPrefix); err != nil {
+							b.Fatalf("Get failed: %v", err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkPut measures Put throughput against distinct hash prefixes, at
+// varying levels of concurrency.
+func BenchmarkPut(b *testing.B) {
+	for name, newLog := range benchReplayLogImpls {
+		for _, level := range concurrencyLevels {
+			b.Run(fmt.Sprintf("%s/concurrency-%d", name, level), func(b *testing.B) {
+				rl := newLog(b)
+				requireNoErr(b, rl.Start())
+				b.Cleanup(func() { requireNoErr(b, rl.Stop()) })
+
+				var counter uint64
+
+				b.ReportAllocs()
+				b.SetParallelism(level)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := atomic.AddUint64(&counter, 1)
+
+						// Use little-endian so that the
+						// low, fast-varying byte of the
+						// counter lands in hashPrefix[0],
+						// which is what ShardedMemoryReplayLog
+						// partitions on; big-endian would pin
+						// it to 0 until the counter exceeded
+						// 2^56, collapsing every run onto a
+						// single shard.
+						hashPrefix := make(HashPrefix, DefaultHashPrefixSize)
+						binary.LittleEndian.PutUint64(hashPrefix[:8], n)
+
+						if err := rl.Put(&hashPrefix, uint32(n)); err != nil {
+							b.Fatalf("Put failed: %v", err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// batchSizes are the batch sizes BenchmarkPutBatch exercises.
+var batchSizes = []int{1, 10, 100}
+
+// BenchmarkPutBatch measures PutBatch throughput across distinct batch IDs,
+// at varying levels of concurrency and batch sizes.
+func BenchmarkPutBatch(b *testing.B) {
+	for name, newLog := range benchReplayLogImpls {
+		for _, level := range concurrencyLevels {
+			for _, batchSize := range batchSizes {
+				benchName := fmt.Sprintf(
+					"%s/concurrency-%d/batch-%d", name, level, batchSize,
+				)
+				b.Run(benchName, func(b *testing.B) {
+					rl := newLog(b)
+					requireNoErr(b, rl.Start())
+					b.Cleanup(func() { requireNoErr(b, rl.Stop()) })
+
+					var counter uint64
+
+					b.ReportAllocs()
+					b.SetParallelism(level)
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						for pb.Next() {
+							batchID := atomic.AddUint64(&counter, 1)
+
+							var idBytes [8]byte
+							binary.BigEndian.PutUint64(idBytes[:], batchID)
+							batch := NewBatch(idBytes[:])
+
+							for i := 0; i < batchSize; i++ {
+								// See the note in BenchmarkPut:
+								// little-endian keeps
+								// hashPrefix[0] well distributed
+								// across the shard-routed byte
+								// instead of pinning it to 0.
+								hashPrefix := make(HashPrefix, DefaultHashPrefixSize)
+								binary.LittleEndian.PutUint64(hashPrefix[:8], batchID)
+								binary.BigEndian.PutUint32(hashPrefix[8:12], uint32(i))
+
+								err := batch.Put(
+									uint16(i), &hashPrefix, uint32(i),
+								)
+								if err != nil {
+									b.Fatalf("batch.Put failed: %v", err)
+								}
+							}
+
+							if _, err := rl.PutBatch(batch); err != nil {
+								b.Fatalf("PutBatch failed: %v", err)
+							}
+						}
+					})
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package sphinx
+
+import "time"
+
+// GCReplayLog is an optional extension of the ReplayLog interface,
+// implemented by ReplayLog implementations that support pruning expired
+// entries as the chain advances. Since every stored entry already carries
+// the CLTV of the HTLC it was found in, a log can bound its own storage by
+// discarding entries once their CLTV has passed, following the same
+// "decayed log" pattern used elsewhere for replay protection.
+type GCReplayLog interface {
+	ReplayLog
+
+	// NotifyBlock informs the log that the chain has advanced to height.
+	// It triggers a garbage collection pass that prunes every stored
+	// entry whose CLTV is less than or equal to height, returning the
+	// number of entries pruned.
+	NotifyBlock(height uint32) (int, error)
+}
+
+// HeightSource abstracts a source of block-height notifications, allowing a
+// GCReplayLog's garbage collector to be driven by an external chain backend
+// (e.g. dcrd) without the sphinx package taking a direct dependency on it.
+type HeightSource interface {
+	// Subscribe returns a channel on which the height of the chain tip is
+	// delivered as it advances, along with a cancel function that must
+	// be called to release the subscription's resources once the
+	// caller is done with it. The returned channel is closed after
+	// cancel is called.
+	Subscribe() (<-chan uint32, func(), error)
+}
+
+// PollingHeightSource is a HeightSource that periodically calls an
+// RPC-shaped height query, for chain backends or test harnesses that don't
+// expose push notifications.
+type PollingHeightSource struct {
+	interval  time.Duration
+	getHeight func() (uint32, error)
+}
+
+// NewPollingHeightSource constructs a PollingHeightSource that calls
+// getHeight every interval to learn of new blocks.
+func NewPollingHeightSource(interval time.Duration,
+	getHeight func() (uint32, error)) *PollingHeightSource {
+
+	return &PollingHeightSource{
+		interval:  interval,
+		getHeight: getHeight,
+	}
+}
+
+// Subscribe starts the polling loop and returns the channel new heights are
+// delivered on.
+func (p *PollingHeightSource) Subscribe() (<-chan uint32, func(), error) {
+	heights := make(chan uint32)
+	quit := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	cancel := func() {
+		select {
+		case <-quit:
+		default:
+			close(quit)
+		}
+		<-cancelled
+	}
+
+	go func() {
+		defer close(heights)
+		defer close(cancelled)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				height, err := p.getHeight()
+				if err != nil {
+					continue
+				}
+
+				select {
+				case heights <- height:
+				case <-quit:
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return heights, cancel, nil
+}
+
+// A compile time assertion to ensure *PollingHeightSource implements the
+// HeightSource interface.
+var _ HeightSource = (*PollingHeightSource)(nil)
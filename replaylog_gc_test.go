@@ -0,0 +1,124 @@
+package sphinx
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPersistentReplayLogNotifyBlockPrunesExpired asserts that NotifyBlock
+// prunes exactly the shared-hash entries whose CLTV has passed, and leaves
+// unexpired entries untouched.
+func TestPersistentReplayLogNotifyBlockPrunesExpired(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay.db")
+	rl := NewPersistentReplayLog(dbPath, WithNoSync(), WithGCBatchSize(1))
+	requireNoErr(t, rl.Start())
+	t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+	expired := []HashPrefix{
+		testHashPrefix(1), testHashPrefix(2), testHashPrefix(3),
+	}
+	unexpired := []HashPrefix{testHashPrefix(4), testHashPrefix(5)}
+
+	for i, hp := range expired {
+		requireNoErr(t, rl.Put(&hp, uint32(10+i)))
+	}
+	for _, hp := range unexpired {
+		requireNoErr(t, rl.Put(&hp, 100))
+	}
+
+	pruned, err := rl.NotifyBlock(50)
+	if err != nil {
+		t.Fatalf("NotifyBlock failed: %v", err)
+	}
+	if pruned != len(expired) {
+		t.Fatalf("expected %d entries pruned, got %d", len(expired), pruned)
+	}
+
+	for _, hp := range expired {
+		_, err := rl.Get(&hp)
+		if !errors.Is(err, ErrLogEntryNotFound) {
+			t.Fatalf("expected expired entry to be pruned, got err: %v", err)
+		}
+	}
+	for _, hp := range unexpired {
+		if _, err := rl.Get(&hp); err != nil {
+			t.Fatalf("expected unexpired entry to survive, got err: %v", err)
+		}
+	}
+}
+
+// TestPersistentReplayLogBatchRecordsAgeOut asserts that a batch's
+// idempotency record is pruned once its configured retention window has
+// elapsed, causing a reprocessed batch to be treated as new rather than
+// idempotent.
+func TestPersistentReplayLogBatchRecordsAgeOut(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay.db")
+	rl := NewPersistentReplayLog(
+		dbPath, WithNoSync(), WithBatchRetention(10),
+	)
+	requireNoErr(t, rl.Start())
+	t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+	hashPrefix := testHashPrefix(1)
+
+	batch := NewBatch([]byte{1})
+	requireNoErr(t, batch.Put(0, &hashPrefix, 1000))
+
+	replays, err := rl.PutBatch(batch)
+	if err != nil || replays.Size() != 0 {
+		t.Fatalf("unexpected result committing batch: %v", err)
+	}
+
+	// Advance past the retention window; the batch record should be
+	// pruned even though the hash prefix's own CLTV has not expired.
+	if _, err := rl.NotifyBlock(11); err != nil {
+		t.Fatalf("NotifyBlock failed: %v", err)
+	}
+
+	// Reprocessing the same batch ID now collides with the still-live
+	// hash prefix entry, since the idempotency record is gone.
+	batch2 := NewBatch([]byte{1})
+	requireNoErr(t, batch2.Put(0, &hashPrefix, 1000))
+
+	replays, err = rl.PutBatch(batch2)
+	if err != nil {
+		t.Fatalf("PutBatch failed: %v", err)
+	}
+	if replays.Size() != 1 || !replays.Contains(0) {
+		t.Fatalf("expected aged-out batch to be reprocessed as a "+
+			"replay, got replay set of size %d", replays.Size())
+	}
+}
+
+// TestPollingHeightSource asserts that a PollingHeightSource delivers
+// heights returned by its query function and that cancel stops delivery.
+func TestPollingHeightSource(t *testing.T) {
+	heightsToReturn := []uint32{1, 2, 3}
+	idx := 0
+
+	src := NewPollingHeightSource(time.Millisecond, func() (uint32, error) {
+		h := heightsToReturn[idx%len(heightsToReturn)]
+		idx++
+		return h, nil
+	})
+
+	heights, cancel, err := src.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	for _, want := range heightsToReturn {
+		got := <-heights
+		if got != want {
+			t.Fatalf("expected height %d, got %d", want, got)
+		}
+	}
+
+	cancel()
+
+	if _, ok := <-heights; ok {
+		t.Fatalf("expected heights channel to be closed after cancel")
+	}
+}
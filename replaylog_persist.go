@@ -0,0 +1,585 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// defaultGCBatchSize is the default number of keys a single garbage
+	// collection pass will examine per write transaction, bounding how
+	// long any one transaction can block other log operations.
+	defaultGCBatchSize = 10000
+
+	// defaultBatchRetention is the default number of blocks a batch's
+	// idempotency record is retained for after it is first committed,
+	// once height notifications are being supplied to the log.
+	defaultBatchRetention = 4032
+)
+
+var (
+	// ErrReplayLogInit is returned when the persistent replay log's
+	// backing database cannot be opened or its bucket structure cannot
+	// be created.
+	ErrReplayLogInit = errors.New("unable to initialize replay log")
+
+	// ErrReplayLogCorrupted is returned when the on-disk state of the
+	// persistent replay log is structurally invalid, e.g. a required
+	// bucket or entry is missing or malformed.
+	ErrReplayLogCorrupted = errors.New("replay log is corrupted")
+)
+
+var (
+	// sharedHashBucket is the bucket mapping a sphinx packet's hash
+	// prefix to the CLTV of the HTLC it was carried in.
+	sharedHashBucket = []byte("shared-hash")
+
+	// batchReplayBucket is the bucket mapping a batch.ID to its encoded
+	// ReplaySet, allowing PutBatch to remain idempotent across restarts.
+	batchReplayBucket = []byte("batch-replay")
+)
+
+// PersistentReplayLogOption is a functional option used to modify the
+// default behavior of a PersistentReplayLog at construction time.
+type PersistentReplayLogOption func(*persistentReplayLogCfg)
+
+// persistentReplayLogCfg houses the configurable parameters of a
+// PersistentReplayLog.
+type persistentReplayLogCfg struct {
+	fileMode  os.FileMode
+	dbTimeout time.Duration
+	noSync    bool
+
+	gcBatchSize    int
+	batchRetention uint32
+	heightSource   HeightSource
+}
+
+// defaultPersistentReplayLogCfg returns the default configuration for a
+// PersistentReplayLog.
+func defaultPersistentReplayLogCfg() *persistentReplayLogCfg {
+	return &persistentReplayLogCfg{
+		fileMode:       0600,
+		dbTimeout:      time.Second,
+		gcBatchSize:    defaultGCBatchSize,
+		batchRetention: defaultBatchRetention,
+	}
+}
+
+// WithFileMode overrides the file mode used when creating the on-disk
+// database file. The default is 0600.
+func WithFileMode(mode os.FileMode) PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		cfg.fileMode = mode
+	}
+}
+
+// WithDBTimeout overrides how long Start will wait to acquire the
+// exclusive lock on the database file before giving up. This ensures that
+// a stale lock left behind by a crashed process causes Start to fail
+// quickly, rather than hang indefinitely. The default is one second.
+func WithDBTimeout(timeout time.Duration) PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		cfg.dbTimeout = timeout
+	}
+}
+
+// WithNoSync disables fsync on every write transaction. This trades
+// durability for speed and is only intended to be used by tests.
+func WithNoSync() PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		cfg.noSync = true
+	}
+}
+
+// WithGCBatchSize overrides the number of keys a single garbage collection
+// pass examines per write transaction. Lowering it bounds how long any one
+// transaction can block other log operations at the cost of more write
+// transactions per pass over the shared-hash and batch-replay buckets; the
+// default is 10,000. Values less than 1
+// are clamped to 1, since a batch size of 0 would never advance past the
+// start of the bucket.
+func WithGCBatchSize(n int) PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		if n < 1 {
+			n = 1
+		}
+		cfg.gcBatchSize = n
+	}
+}
+
+// WithBatchRetention overrides the number of blocks a batch's idempotency
+// record is kept for, once height notifications are being supplied to the
+// log via NotifyBlock or a HeightSource. The default is 4032 blocks.
+func WithBatchRetention(blocks uint32) PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		cfg.batchRetention = blocks
+	}
+}
+
+// WithHeightSource wires a HeightSource into the log, causing Start to
+// launch a background goroutine that calls NotifyBlock for every height the
+// source delivers, driving the log's garbage collector automatically. The
+// subscription is released when Stop is called.
+func WithHeightSource(hs HeightSource) PersistentReplayLogOption {
+	return func(cfg *persistentReplayLogCfg) {
+		cfg.heightSource = hs
+	}
+}
+
+// PersistentReplayLog is a ReplayLog implementation backed by a bbolt
+// database, so that replay protection for sphinx packets survives node
+// restarts. Every mutation PutBatch makes to the shared-hash and
+// batch-replay buckets is committed within a single bbolt write
+// transaction, so a crash mid-batch cannot leave the log in a partially
+// updated state. All methods are safe for concurrent access, guarded by a
+// dedicated mutex that protects the backing database handle from Stop
+// closing it out from underneath an in-flight Get/Put/Delete/PutBatch/
+// NotifyBlock call.
+type PersistentReplayLog struct {
+	cfg *persistentReplayLogCfg
+
+	dbPath string
+
+	dbMu sync.RWMutex
+	db   *bbolt.DB
+
+	heightMtx     sync.Mutex
+	currentHeight uint32
+
+	cancelGC func()
+	wg       sync.WaitGroup
+}
+
+// NewPersistentReplayLog constructs a new PersistentReplayLog that will
+// store its state in the file at dbPath. Start must be called on the
+// returned log before it can be used.
+func NewPersistentReplayLog(dbPath string,
+	opts ...PersistentReplayLogOption) *PersistentReplayLog {
+
+	cfg := defaultPersistentReplayLogCfg()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &PersistentReplayLog{
+		cfg:    cfg,
+		dbPath: dbPath,
+	}
+}
+
+// Start opens the backing bbolt database, creating the shared-hash and
+// batch-replay buckets if they do not already exist.
+func (rl *PersistentReplayLog) Start() error {
+	db, err := bbolt.Open(rl.dbPath, rl.cfg.fileMode, &bbolt.Options{
+		Timeout: rl.cfg.dbTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReplayLogInit, err)
+	}
+
+	db.NoSync = rl.cfg.noSync
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sharedHashBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(batchReplayBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("%w: %v", ErrReplayLogInit, err)
+	}
+
+	rl.dbMu.Lock()
+	rl.db = db
+	rl.dbMu.Unlock()
+
+	if rl.cfg.heightSource != nil {
+		heights, cancel, err := rl.cfg.heightSource.Subscribe()
+		if err != nil {
+			db.Close()
+
+			rl.dbMu.Lock()
+			rl.db = nil
+			rl.dbMu.Unlock()
+
+			return fmt.Errorf("%w: %v", ErrReplayLogInit, err)
+		}
+
+		rl.cancelGC = cancel
+		rl.wg.Add(1)
+		go func() {
+			defer rl.wg.Done()
+
+			for height := range heights {
+				// Best-effort: a failed GC pass simply means
+				// this height's pruning is retried on the
+				// next notification.
+				_, _ = rl.NotifyBlock(height)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Stop releases the height source subscription (if any), waits for the
+// garbage collector goroutine to exit, then flushes and closes the backing
+// database.
+func (rl *PersistentReplayLog) Stop() error {
+	rl.dbMu.RLock()
+	started := rl.db != nil
+	rl.dbMu.RUnlock()
+
+	if !started {
+		return errReplayLogNotStarted
+	}
+
+	if rl.cancelGC != nil {
+		rl.cancelGC()
+		rl.cancelGC = nil
+	}
+	rl.wg.Wait()
+
+	rl.dbMu.Lock()
+	defer rl.dbMu.Unlock()
+
+	err := rl.db.Close()
+	rl.db = nil
+	return err
+}
+
+// Get retrieves an entry from the log given its hash prefix. It returns the
+// value stored and an error if one occurs. It returns ErrLogEntryNotFound
+// if the entry is not in the log.
+func (rl *PersistentReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	rl.dbMu.RLock()
+	defer rl.dbMu.RUnlock()
+
+	if rl.db == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	var cltv uint32
+	err := rl.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sharedHashBucket)
+		if bucket == nil {
+			return ErrReplayLogCorrupted
+		}
+
+		v := bucket.Get(*hash)
+		if v == nil {
+			return ErrLogEntryNotFound
+		}
+		if len(v) != 4 {
+			return ErrReplayLogCorrupted
+		}
+
+		cltv = binary.BigEndian.Uint32(v)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return cltv, nil
+}
+
+// Put stores an entry into the log given its hash prefix and an
+// accompanying purposefully general type. It returns ErrReplayedPacket if
+// the provided hash prefix already exists in the log.
+func (rl *PersistentReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	rl.dbMu.RLock()
+	defer rl.dbMu.RUnlock()
+
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.db.Update(func(tx *bbolt.Tx) error {
+		return putHashPrefix(tx, hash, cltv)
+	})
+}
+
+// putHashPrefix writes a single hash prefix/CLTV pair into the shared-hash
+// bucket of the provided transaction, returning ErrReplayedPacket if the
+// prefix is already present.
+func putHashPrefix(tx *bbolt.Tx, hash *HashPrefix, cltv uint32) error {
+	bucket := tx.Bucket(sharedHashBucket)
+	if bucket == nil {
+		return ErrReplayLogCorrupted
+	}
+
+	if bucket.Get(*hash) != nil {
+		return ErrReplayedPacket
+	}
+
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], cltv)
+	return bucket.Put(*hash, v[:])
+}
+
+// Delete deletes an entry from the log given its hash prefix.
+func (rl *PersistentReplayLog) Delete(hash *HashPrefix) error {
+	rl.dbMu.RLock()
+	defer rl.dbMu.RUnlock()
+
+	if rl.db == nil {
+		return errReplayLogNotStarted
+	}
+
+	return rl.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(sharedHashBucket)
+		if bucket == nil {
+			return ErrReplayLogCorrupted
+		}
+		return bucket.Delete(*hash)
+	})
+}
+
+// PutBatch stores a batch of sphinx packets into the log given their hash
+// prefixes and accompanying values. Returns the set of entries in the
+// batch that are replays and an error if one occurs. All new hash prefixes
+// and the resulting ReplaySet are written within a single transaction, so
+// a crash mid-batch cannot produce partial state, and a previously
+// committed batch.ID is recognized and its stored ReplaySet returned
+// as-is, making PutBatch idempotent across restarts.
+func (rl *PersistentReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.dbMu.RLock()
+	defer rl.dbMu.RUnlock()
+
+	if rl.db == nil {
+		return nil, errReplayLogNotStarted
+	}
+
+	rl.heightMtx.Lock()
+	height := rl.currentHeight
+	rl.heightMtx.Unlock()
+
+	var replays *ReplaySet
+	err := rl.db.Update(func(tx *bbolt.Tx) error {
+		batchBucket := tx.Bucket(batchReplayBucket)
+		if batchBucket == nil {
+			return ErrReplayLogCorrupted
+		}
+
+		// Return the result when the batch was first processed to
+		// provide idempotence, even across restarts.
+		if v := batchBucket.Get(batch.ID); v != nil {
+			var err error
+			replays, err = decodeBatchRecord(v)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrReplayLogCorrupted, err)
+			}
+			return nil
+		}
+
+		replays = NewReplaySet()
+		err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix,
+			cltv uint32) error {
+
+			err := putHashPrefix(tx, hashPrefix, cltv)
+			if errors.Is(err, ErrReplayedPacket) {
+				replays.Add(seqNum)
+				return nil
+			}
+
+			// An error would be bad because we have already
+			// updated the shared-hash bucket within this
+			// transaction, but no errors other than
+			// ErrReplayedPacket should occur.
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		replays.Merge(batch.ReplaySet)
+
+		expiry := height + rl.cfg.batchRetention
+		v, err := encodeBatchRecord(expiry, replays)
+		if err != nil {
+			return err
+		}
+
+		return batchBucket.Put(batch.ID, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	return replays, nil
+}
+
+// encodeBatchRecord serializes a batch's expiry height and ReplaySet into
+// the value stored under its batch.ID key in the batch-replay bucket.
+func encodeBatchRecord(expiry uint32, replays *ReplaySet) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var expiryBytes [4]byte
+	binary.BigEndian.PutUint32(expiryBytes[:], expiry)
+	buf.Write(expiryBytes[:])
+
+	if err := replays.Encode(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeBatchRecord parses a value read from the batch-replay bucket back
+// into its ReplaySet, skipping the leading expiry height (see
+// batchRecordExpiry).
+func decodeBatchRecord(v []byte) (*ReplaySet, error) {
+	if len(v) < 4 {
+		return nil, errors.New("batch record too short")
+	}
+
+	replays := NewReplaySet()
+	if err := replays.Decode(bytes.NewReader(v[4:])); err != nil {
+		return nil, err
+	}
+
+	return replays, nil
+}
+
+// batchRecordExpiry extracts just the expiry height from a batch-replay
+// bucket value, without decoding the ReplaySet it's paired with.
+func batchRecordExpiry(v []byte) (uint32, error) {
+	if len(v) < 4 {
+		return 0, errors.New("batch record too short")
+	}
+
+	return binary.BigEndian.Uint32(v[:4]), nil
+}
+
+// NotifyBlock informs the log that the chain has advanced to height,
+// triggering a garbage collection pass over both the shared-hash and
+// batch-replay buckets. Entries whose CLTV (or, for batch records, expiry
+// height) is less than or equal to height are pruned. The scan is done in
+// chunks of at most the configured GC batch size (see WithGCBatchSize) keys
+// per write transaction, so a large log
+// doesn't block other operations for the duration of a full pass. It
+// returns the total number of entries pruned.
+func (rl *PersistentReplayLog) NotifyBlock(height uint32) (int, error) {
+	rl.dbMu.RLock()
+	defer rl.dbMu.RUnlock()
+
+	if rl.db == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	rl.heightMtx.Lock()
+	if height > rl.currentHeight {
+		rl.currentHeight = height
+	}
+	rl.heightMtx.Unlock()
+
+	prunedHashes, err := rl.gcBucket(sharedHashBucket, func(v []byte) (bool, error) {
+		if len(v) != 4 {
+			return false, ErrReplayLogCorrupted
+		}
+		return binary.BigEndian.Uint32(v) <= height, nil
+	})
+	if err != nil {
+		return prunedHashes, err
+	}
+
+	prunedBatches, err := rl.gcBucket(batchReplayBucket, func(v []byte) (bool, error) {
+		expiry, err := batchRecordExpiry(v)
+		if err != nil {
+			return false, ErrReplayLogCorrupted
+		}
+		return expiry <= height, nil
+	})
+	if err != nil {
+		return prunedHashes + prunedBatches, err
+	}
+
+	return prunedHashes + prunedBatches, nil
+}
+
+// gcBucket walks every key in the named bucket in chunks of at most
+// cfg.gcBatchSize keys per write transaction, deleting any key whose value the
+// provided shouldDelete predicate reports as expired. It returns the total
+// number of keys deleted.
+func (rl *PersistentReplayLog) gcBucket(bucketName []byte,
+	shouldDelete func(v []byte) (bool, error)) (int, error) {
+
+	var (
+		pruned  int
+		lastKey []byte
+	)
+
+	for {
+		var examined int
+		err := rl.db.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(bucketName)
+			if bucket == nil {
+				return ErrReplayLogCorrupted
+			}
+
+			c := bucket.Cursor()
+
+			var k, v []byte
+			if lastKey == nil {
+				k, v = c.First()
+			} else {
+				// Seek lands on lastKey if it's still
+				// present, in which case we need to advance
+				// past it; if it was deleted in the previous
+				// chunk, Seek already lands on the next
+				// unprocessed key and we must not skip it.
+				k, v = c.Seek(lastKey)
+				if k != nil && bytes.Equal(k, lastKey) {
+					k, v = c.Next()
+				}
+			}
+
+			for ; k != nil && examined < rl.cfg.gcBatchSize; examined++ {
+				lastKey = append([]byte(nil), k...)
+
+				del, err := shouldDelete(v)
+				if err != nil {
+					return err
+				}
+				if del {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					pruned++
+				}
+
+				k, v = c.Next()
+			}
+
+			return nil
+		})
+		if err != nil {
+			return pruned, err
+		}
+
+		if examined < rl.cfg.gcBatchSize {
+			return pruned, nil
+		}
+	}
+}
+
+// A compile time assertion to ensure *PersistentReplayLog implements the
+// ReplayLog and GCReplayLog interfaces.
+var (
+	_ ReplayLog   = (*PersistentReplayLog)(nil)
+	_ GCReplayLog = (*PersistentReplayLog)(nil)
+)
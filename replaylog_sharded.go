@@ -0,0 +1,295 @@
+package sphinx
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultShardCount is the number of shards a ShardedMemoryReplayLog
+// partitions its entries across when none is explicitly configured.
+const defaultShardCount = 16
+
+// replayShard is a single partition of a ShardedMemoryReplayLog's entries,
+// independently guarded so that unrelated packets routed to other shards
+// don't contend on this shard's lock.
+type replayShard struct {
+	mu      sync.RWMutex
+	entries map[string]uint32
+}
+
+// ShardedMemoryReplayLogOption is a functional option used to modify the
+// default behavior of a ShardedMemoryReplayLog at construction time.
+type ShardedMemoryReplayLogOption func(*shardedMemoryReplayLogCfg)
+
+type shardedMemoryReplayLogCfg struct {
+	numShards int
+}
+
+// WithShardCount overrides the number of shards entries are partitioned
+// across. numShards must be in [1, 256], since shard selection is keyed by
+// a single byte of the hash prefix. The default is 16.
+func WithShardCount(numShards int) ShardedMemoryReplayLogOption {
+	return func(cfg *shardedMemoryReplayLogCfg) {
+		cfg.numShards = numShards
+	}
+}
+
+// ShardedMemoryReplayLog is a ReplayLog implementation that, like
+// MemoryReplayLog, stores all added sphinx packets and processed batches in
+// memory with no persistence, but partitions its entries across N shards
+// keyed by the first byte of each HashPrefix. Each shard has its own
+// sync.RWMutex, so PutBatch calls touching unrelated hash prefixes don't
+// serialize on a single lock the way MemoryReplayLog's single map does.
+// All methods are safe for concurrent access.
+//
+// This is designed for use just in testing.
+type ShardedMemoryReplayLog struct {
+	shards []*replayShard
+
+	batchMu    sync.Mutex
+	batches    map[string]*ReplaySet
+	batchLocks map[string]*sync.Mutex
+
+	started bool
+}
+
+// NewShardedMemoryReplayLog constructs a new ShardedMemoryReplayLog.
+func NewShardedMemoryReplayLog(
+	opts ...ShardedMemoryReplayLogOption) *ShardedMemoryReplayLog {
+
+	cfg := &shardedMemoryReplayLogCfg{numShards: defaultShardCount}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	shards := make([]*replayShard, cfg.numShards)
+	for i := range shards {
+		shards[i] = &replayShard{}
+	}
+
+	return &ShardedMemoryReplayLog{shards: shards}
+}
+
+// shardFor returns the shard a given hash prefix is routed to.
+func (rl *ShardedMemoryReplayLog) shardFor(hash *HashPrefix) *replayShard {
+	idx := int((*hash)[0]) % len(rl.shards)
+	return rl.shards[idx]
+}
+
+// Start initializes the log and must be called before any other methods.
+func (rl *ShardedMemoryReplayLog) Start() error {
+	rl.batchMu.Lock()
+	defer rl.batchMu.Unlock()
+
+	for _, shard := range rl.shards {
+		shard.mu.Lock()
+		shard.entries = make(map[string]uint32)
+		shard.mu.Unlock()
+	}
+
+	rl.batches = make(map[string]*ReplaySet)
+	rl.batchLocks = make(map[string]*sync.Mutex)
+	rl.started = true
+	return nil
+}
+
+// Stop wipes the state of the log.
+func (rl *ShardedMemoryReplayLog) Stop() error {
+	rl.batchMu.Lock()
+	defer rl.batchMu.Unlock()
+
+	if !rl.started {
+		return errReplayLogNotStarted
+	}
+
+	for _, shard := range rl.shards {
+		shard.mu.Lock()
+		shard.entries = nil
+		shard.mu.Unlock()
+	}
+
+	rl.batches = nil
+	rl.batchLocks = nil
+	rl.started = false
+	return nil
+}
+
+// Get retrieves an entry from the log given its hash prefix. It returns the
+// value stored and an error if one occurs. It returns ErrLogEntryNotFound
+// if the entry is not in the log.
+func (rl *ShardedMemoryReplayLog) Get(hash *HashPrefix) (uint32, error) {
+	shard := rl.shardFor(hash)
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if shard.entries == nil {
+		return 0, errReplayLogNotStarted
+	}
+
+	cltv, exists := shard.entries[string(*hash)]
+	if !exists {
+		return 0, ErrLogEntryNotFound
+	}
+
+	return cltv, nil
+}
+
+// Put stores an entry into the log given its hash prefix and an
+// accompanying purposefully general type. It returns ErrReplayedPacket if
+// the provided hash prefix already exists in the log.
+func (rl *ShardedMemoryReplayLog) Put(hash *HashPrefix, cltv uint32) error {
+	shard := rl.shardFor(hash)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return putShardEntry(shard, hash, cltv)
+}
+
+// putShardEntry writes a hash prefix/CLTV pair into shard, returning
+// ErrReplayedPacket if the prefix is already present. The caller must hold
+// shard.mu for writing.
+func putShardEntry(shard *replayShard, hash *HashPrefix, cltv uint32) error {
+	if shard.entries == nil {
+		return errReplayLogNotStarted
+	}
+
+	if _, exists := shard.entries[string(*hash)]; exists {
+		return ErrReplayedPacket
+	}
+
+	shard.entries[string(*hash)] = cltv
+	return nil
+}
+
+// Delete deletes an entry from the log given its hash prefix.
+func (rl *ShardedMemoryReplayLog) Delete(hash *HashPrefix) error {
+	shard := rl.shardFor(hash)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.entries == nil {
+		return errReplayLogNotStarted
+	}
+
+	delete(shard.entries, string(*hash))
+	return nil
+}
+
+// PutBatch stores a batch of sphinx packets into the log given their hash
+// prefixes and accompanying values. Returns the set of entries in the batch
+// that are replays and an error if one occurs. Entries are grouped by the
+// shard they're routed to and written concurrently, so unrelated packets
+// within the same batch don't contend on a single lock. The idempotency
+// check and record for a given batch.ID are serialized against concurrent
+// PutBatch calls for that same ID via a per-batch-ID lock, so that two
+// callers racing to commit the same batch always observe one consistent
+// ReplaySet; unrelated batch IDs still proceed concurrently.
+func (rl *ShardedMemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	rl.batchMu.Lock()
+	if !rl.started {
+		rl.batchMu.Unlock()
+		return nil, errReplayLogNotStarted
+	}
+
+	// Return the result when the batch was first processed to provide
+	// idempotence.
+	if replays, exists := rl.batches[string(batch.ID)]; exists {
+		rl.batchMu.Unlock()
+
+		batch.ReplaySet = replays
+		batch.IsCommitted = true
+		return replays, nil
+	}
+
+	batchLock, exists := rl.batchLocks[string(batch.ID)]
+	if !exists {
+		batchLock = &sync.Mutex{}
+		rl.batchLocks[string(batch.ID)] = batchLock
+	}
+	rl.batchMu.Unlock()
+
+	batchLock.Lock()
+	defer batchLock.Unlock()
+
+	// Re-check idempotence now that we hold the per-batch lock, in case
+	// another goroutine committed this exact batch.ID while we were
+	// waiting for the lock above.
+	rl.batchMu.Lock()
+	if replays, exists := rl.batches[string(batch.ID)]; exists {
+		rl.batchMu.Unlock()
+
+		batch.ReplaySet = replays
+		batch.IsCommitted = true
+		return replays, nil
+	}
+	rl.batchMu.Unlock()
+
+	type shardJob struct {
+		seqNum     uint16
+		hashPrefix HashPrefix
+		cltv       uint32
+	}
+
+	byShard := make(map[int][]shardJob)
+	err := batch.ForEach(func(seqNum uint16, hashPrefix *HashPrefix,
+		cltv uint32) error {
+
+		// Copy the hash prefix out of the pointer handed to us now,
+		// since it points at a loop variable inside batch.ForEach
+		// that is reused across iterations and will not survive
+		// until the shard goroutines below actually run.
+		idx := int((*hashPrefix)[0]) % len(rl.shards)
+		byShard[idx] = append(byShard[idx], shardJob{
+			seqNum:     seqNum,
+			hashPrefix: *hashPrefix,
+			cltv:       cltv,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replays := NewReplaySet()
+	var replaysMu sync.Mutex
+
+	var wg sync.WaitGroup
+	for idx, jobs := range byShard {
+		wg.Add(1)
+		go func(shard *replayShard, jobs []shardJob) {
+			defer wg.Done()
+
+			shard.mu.Lock()
+			defer shard.mu.Unlock()
+
+			for _, job := range jobs {
+				err := putShardEntry(shard, &job.hashPrefix, job.cltv)
+				if errors.Is(err, ErrReplayedPacket) {
+					replaysMu.Lock()
+					replays.Add(job.seqNum)
+					replaysMu.Unlock()
+				}
+			}
+		}(rl.shards[idx], jobs)
+	}
+	wg.Wait()
+
+	replays.Merge(batch.ReplaySet)
+
+	rl.batchMu.Lock()
+	rl.batches[string(batch.ID)] = replays
+	delete(rl.batchLocks, string(batch.ID))
+	rl.batchMu.Unlock()
+
+	batch.ReplaySet = replays
+	batch.IsCommitted = true
+
+	return replays, nil
+}
+
+// A compile time assertion to ensure *ShardedMemoryReplayLog implements the
+// ReplayLog interface.
+var _ ReplayLog = (*ShardedMemoryReplayLog)(nil)
@@ -0,0 +1,287 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replayLogImpls enumerates the ReplayLog implementations that are expected
+// to satisfy the behavior asserted by this file's tests.
+var replayLogImpls = map[string]func(t *testing.T) ReplayLog{
+	"memory": func(t *testing.T) ReplayLog {
+		return NewMemoryReplayLog()
+	},
+	"sharded": func(t *testing.T) ReplayLog {
+		return NewShardedMemoryReplayLog()
+	},
+	"persistent": func(t *testing.T) ReplayLog {
+		dbPath := filepath.Join(t.TempDir(), "replay.db")
+		return NewPersistentReplayLog(dbPath, WithNoSync())
+	},
+}
+
+// TestReplayLogStorageAndRetrieval tests that the non-batch methods on
+// every ReplayLog implementation work as expected.
+func TestReplayLogStorageAndRetrieval(t *testing.T) {
+	for name, newLog := range replayLogImpls {
+		t.Run(name, func(t *testing.T) {
+			rl := newLog(t)
+			requireNoErr(t, rl.Start())
+			t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+			hashPrefix := testHashPrefix(1)
+
+			var cltv1 uint32 = 1
+
+			// Attempt to lookup unknown sphinx packet.
+			_, err := rl.Get(&hashPrefix)
+			if err == nil {
+				t.Fatalf("Expected ErrLogEntryNotFound")
+			}
+			if !errors.Is(err, ErrLogEntryNotFound) {
+				t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+			}
+
+			// Log incoming sphinx packet.
+			err = rl.Put(&hashPrefix, cltv1)
+			if err != nil {
+				t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+			}
+
+			// Attempt to replay sphinx packet.
+			err = rl.Put(&hashPrefix, cltv1)
+			if err == nil {
+				t.Fatalf("Expected ErrReplayedPacket")
+			}
+			if !errors.Is(err, ErrReplayedPacket) {
+				t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+			}
+
+			// Lookup logged sphinx packet.
+			cltv, err := rl.Get(&hashPrefix)
+			if err != nil {
+				t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+			}
+			if cltv != cltv1 {
+				t.Fatalf("Get returned wrong value: expected %v, got %v", cltv1, cltv)
+			}
+
+			// Delete sphinx packet from log.
+			err = rl.Delete(&hashPrefix)
+			if err != nil {
+				t.Fatalf("Delete failed - received unexpected error upon Delete: %v", err)
+			}
+
+			// Attempt to lookup deleted sphinx packet.
+			_, err = rl.Get(&hashPrefix)
+			if err == nil {
+				t.Fatalf("Expected ErrLogEntryNotFound")
+			}
+			if !errors.Is(err, ErrLogEntryNotFound) {
+				t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+			}
+
+			// Reinsert incoming sphinx packet into the log.
+			var cltv2 uint32 = 2
+			err = rl.Put(&hashPrefix, cltv2)
+			if err != nil {
+				t.Fatalf("Put failed - received unexpected error upon Put: %v", err)
+			}
+
+			// Lookup logged sphinx packet.
+			cltv, err = rl.Get(&hashPrefix)
+			if err != nil {
+				t.Fatalf("Get failed - received unexpected error upon Get: %v", err)
+			}
+			if cltv != cltv2 {
+				t.Fatalf("Get returned wrong value: expected %v, got %v", cltv2, cltv)
+			}
+		})
+	}
+}
+
+// TestReplayLogPutBatch tests that the batch adding of packets to a log
+// works as expected, and remains idempotent, across every ReplayLog
+// implementation.
+func TestReplayLogPutBatch(t *testing.T) {
+	for name, newLog := range replayLogImpls {
+		t.Run(name, func(t *testing.T) {
+			rl := newLog(t)
+			requireNoErr(t, rl.Start())
+			t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+			hashPrefix1 := testHashPrefix(1)
+			hashPrefix2 := testHashPrefix(2)
+
+			// Create a batch with a duplicated packet.
+			batch1 := NewBatch([]byte{1})
+			err := batch1.Put(1, &hashPrefix1, 1)
+			if err != nil {
+				t.Fatalf("Unexpected error adding entry to batch: %v", err)
+			}
+			err = batch1.Put(1, &hashPrefix1, 1)
+			if err != nil {
+				t.Fatalf("Unexpected error adding entry to batch: %v", err)
+			}
+
+			replays, err := rl.PutBatch(batch1)
+			if err != nil || replays.Size() != 1 || !replays.Contains(1) {
+				t.Fatalf("Unexpected replay set after adding batch 1 to log: %v", err)
+			}
+
+			// Create a batch with one replayed packet and one valid
+			// one.
+			batch2 := NewBatch([]byte{2})
+			err = batch2.Put(1, &hashPrefix1, 1)
+			if err != nil {
+				t.Fatalf("Unexpected error adding entry to batch: %v", err)
+			}
+			err = batch2.Put(2, &hashPrefix2, 2)
+			if err != nil {
+				t.Fatalf("Unexpected error adding entry to batch: %v", err)
+			}
+
+			replays, err = rl.PutBatch(batch2)
+			if err != nil || replays.Size() != 1 || !replays.Contains(1) {
+				t.Fatalf("Unexpected replay set after adding batch 2 to log: %v", err)
+			}
+
+			// Reprocess batch 2, which should be idempotent.
+			replays, err = rl.PutBatch(batch2)
+			if err != nil || replays.Size() != 1 || !replays.Contains(1) {
+				t.Fatalf("Unexpected replay set after adding batch 2 to log: %v", err)
+			}
+		})
+	}
+}
+
+// TestPersistentReplayLogSurvivesRestart asserts that entries and committed
+// batches written by a PersistentReplayLog are still present after the
+// database is closed and reopened, unlike MemoryReplayLog.
+func TestPersistentReplayLogSurvivesRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay.db")
+
+	rl := NewPersistentReplayLog(dbPath, WithNoSync())
+	requireNoErr(t, rl.Start())
+
+	directPrefix := testHashPrefix(1)
+	batchPrefix := testHashPrefix(2)
+	requireNoErr(t, rl.Put(&directPrefix, 42))
+
+	batch := NewBatch([]byte{1})
+	requireNoErr(t, batch.Put(0, &batchPrefix, 43))
+	_, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("PutBatch failed: %v", err)
+	}
+
+	requireNoErr(t, rl.Stop())
+
+	// Reopen the database and confirm both the entry and the batch's
+	// idempotency record survived.
+	rl = NewPersistentReplayLog(dbPath, WithNoSync())
+	requireNoErr(t, rl.Start())
+	t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+	cltv, err := rl.Get(&directPrefix)
+	if err != nil {
+		t.Fatalf("Get failed after restart: %v", err)
+	}
+	if cltv != 42 {
+		t.Fatalf("Get returned wrong value after restart: expected 42, got %v", cltv)
+	}
+
+	replays, err := rl.PutBatch(batch)
+	if err != nil {
+		t.Fatalf("PutBatch failed after restart: %v", err)
+	}
+	if replays.Size() != 0 {
+		t.Fatalf("expected no replays reprocessing already committed batch, "+
+			"got %d", replays.Size())
+	}
+}
+
+// fnv64ReplayHasher is a test-only ReplayHasher producing 8-byte prefixes,
+// used to exercise HashPrefix pluggability against a real ReplayLog with a
+// hash function and prefix length other than DefaultReplayHasher's.
+type fnv64ReplayHasher struct{}
+
+func (fnv64ReplayHasher) Hash(shared *Hash256) HashPrefix {
+	h := fnv.New64a()
+	h.Write(shared[:])
+
+	hp := make(HashPrefix, 8)
+	binary.BigEndian.PutUint64(hp, h.Sum64())
+	return hp
+}
+
+func (fnv64ReplayHasher) PrefixLen() int {
+	return 8
+}
+
+// TestCustomReplayHasher asserts that a non-default ReplayHasher's prefixes
+// work end-to-end through a ReplayLog: derived consistently from a shared
+// secret via hashSharedSecret, and detected as replays across repeated
+// derivations of the same secret. This chunk of the tree has no Router or
+// ProcessOnionPacket to wire a custom hasher through, so this is the
+// closest available stand-in for that integration.
+func TestCustomReplayHasher(t *testing.T) {
+	hasher := fnv64ReplayHasher{}
+
+	var shared Hash256
+	shared[0] = 0xab
+
+	hashPrefix := hashSharedSecret(&shared, hasher)
+	if len(hashPrefix) != hasher.PrefixLen() {
+		t.Fatalf("expected prefix of length %d, got %d",
+			hasher.PrefixLen(), len(hashPrefix))
+	}
+
+	rl := NewMemoryReplayLog()
+	requireNoErr(t, rl.Start())
+	t.Cleanup(func() { requireNoErr(t, rl.Stop()) })
+
+	requireNoErr(t, rl.Put(&hashPrefix, 10))
+
+	cltv, err := rl.Get(&hashPrefix)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if cltv != 10 {
+		t.Fatalf("Get returned wrong value: expected 10, got %v", cltv)
+	}
+
+	// Rehashing the same shared secret must reproduce the same prefix,
+	// so that a replayed packet is recognized as such.
+	replayedPrefix := hashSharedSecret(&shared, hasher)
+	err = rl.Put(&replayedPrefix, 10)
+	if !errors.Is(err, ErrReplayedPacket) {
+		t.Fatalf("expected ErrReplayedPacket, got: %v", err)
+	}
+}
+
+// TestPersistentReplayLogStaleLockFailsFast asserts that Start returns
+// promptly, rather than hanging, when the database file is already locked
+// by another process/handle.
+func TestPersistentReplayLogStaleLockFailsFast(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay.db")
+
+	holder := NewPersistentReplayLog(dbPath, WithNoSync())
+	requireNoErr(t, holder.Start())
+	t.Cleanup(func() { requireNoErr(t, holder.Stop()) })
+
+	contender := NewPersistentReplayLog(
+		dbPath, WithNoSync(), WithDBTimeout(time.Millisecond*50),
+	)
+	err := contender.Start()
+	if err == nil {
+		t.Fatalf("expected Start to fail while database is locked")
+	}
+	if !errors.Is(err, ErrReplayLogInit) {
+		t.Fatalf("expected ErrReplayLogInit, got: %v", err)
+	}
+}
@@ -8,3 +8,12 @@ func requireNoErr(t testing.TB, err error) {
 		t.Fatal(err)
 	}
 }
+
+// testHashPrefix returns a HashPrefix of DefaultHashPrefixSize bytes whose
+// first byte is b, for tests that need distinct, realistically-sized
+// prefixes without depending on a particular ReplayHasher.
+func testHashPrefix(b byte) HashPrefix {
+	hp := make(HashPrefix, DefaultHashPrefixSize)
+	hp[0] = b
+	return hp
+}